@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config describes one or more sync targets to run in a single reposync
+// invocation, loaded via -config. It complements the flag-based single-target
+// mode rather than replacing it.
+type Config struct {
+	// Jobs bounds how many git operations run at once across all targets
+	// combined, so a config with many large orgs doesn't fork hundreds of
+	// concurrent git processes. Defaults to runtime.NumCPU().
+	Jobs    int            `yaml:"jobs"`
+	Targets []ConfigTarget `yaml:"targets"`
+}
+
+// ConfigTarget is a single user or org to sync, with its own destination,
+// credentials, and filters.
+type ConfigTarget struct {
+	User          string   `yaml:"user"`
+	UserRepoType  string   `yaml:"userrepotype"`
+	UserRepoForks *bool    `yaml:"userrepoforks"`
+	Org           string   `yaml:"org"`
+	OrgRepoType   string   `yaml:"orgrepotype"`
+	Dir           string   `yaml:"dir"`
+	ArchiveDir    string   `yaml:"archivedir"`
+	Token         string   `yaml:"token"`
+	Provider      string   `yaml:"provider"`
+	Host          string   `yaml:"host"`
+	Include       []string `yaml:"include"`
+	Exclude       []string `yaml:"exclude"`
+	Topic         string   `yaml:"topic"`
+	Language      string   `yaml:"language"`
+	MaxSizeKB     int      `yaml:"max_size_kb"`
+	SkipArchived  bool     `yaml:"skip_archived"`
+	DryRun        bool     `yaml:"dryrun"`
+	Update        bool     `yaml:"update"`
+	Bare          bool     `yaml:"bare"`
+	Prune         bool     `yaml:"prune"`
+	// Retries and RetryBase configure the same retry/backoff as the -retries
+	// and -retry-base flags. RetryBase is a duration string like "500ms".
+	Retries   int    `yaml:"retries"`
+	RetryBase string `yaml:"retry_base"`
+}
+
+// LoadConfig reads and parses a reposync YAML config from path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("%s: must define at least one target", path)
+	}
+	if cfg.Jobs <= 0 {
+		cfg.Jobs = runtime.NumCPU()
+	}
+	return &cfg, nil
+}
+
+// toRepoSync builds the RepoSync for this target, sharing pool across all
+// targets run from the same Config so their git operations are bounded
+// together rather than per-target.
+func (t ConfigTarget) toRepoSync(pool chan struct{}) (RepoSync, error) {
+	userRepoForks := true
+	if t.UserRepoForks != nil {
+		userRepoForks = *t.UserRepoForks
+	}
+	userRepoType := t.UserRepoType
+	if userRepoType == "" {
+		userRepoType = "all"
+	}
+	orgRepoType := t.OrgRepoType
+	if orgRepoType == "" {
+		orgRepoType = "all"
+	}
+	include, err := compileRegexps(t.Include)
+	if err != nil {
+		return RepoSync{}, fmt.Errorf("include: %s", err)
+	}
+	exclude, err := compileRegexps(t.Exclude)
+	if err != nil {
+		return RepoSync{}, fmt.Errorf("exclude: %s", err)
+	}
+	retryBase := 500 * time.Millisecond
+	if t.RetryBase != "" {
+		retryBase, err = time.ParseDuration(t.RetryBase)
+		if err != nil {
+			return RepoSync{}, fmt.Errorf("retry_base: %s", err)
+		}
+	}
+	return RepoSync{
+		user:          t.User,
+		userRepoType:  userRepoType,
+		userRepoForks: userRepoForks,
+		org:           t.Org,
+		orgRepoType:   orgRepoType,
+		workdir:       t.Dir,
+		archivedir:    t.ArchiveDir,
+		token:         t.Token,
+		dryrun:        t.DryRun,
+		update:        t.Update,
+		bare:          t.Bare,
+		prune:         t.Prune,
+		provider:      t.Provider,
+		host:          t.Host,
+		include:       include,
+		exclude:       exclude,
+		topic:         t.Topic,
+		language:      t.Language,
+		maxSizeKB:     t.MaxSizeKB,
+		skipArchived:  t.SkipArchived,
+		retries:       t.Retries,
+		retryBase:     retryBase,
+		pool:          pool,
+	}, nil
+}
+
+// compileRegexps compiles each pattern, matching how -include/-exclude are
+// validated on the flag-based path.
+func compileRegexps(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// RunConfig runs every target in cfg, sharing a single bounded worker pool
+// across all of them so a config with many large orgs doesn't fork hundreds
+// of concurrent git processes.
+func RunConfig(cfg *Config) error {
+	pool := make(chan struct{}, cfg.Jobs)
+	var wg sync.WaitGroup
+	errs := make([]error, len(cfg.Targets))
+	for i, target := range cfg.Targets {
+		wg.Add(1)
+		go func(i int, target ConfigTarget) {
+			defer wg.Done()
+			rs, err := target.toRepoSync(pool)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s/%s: %s", target.Org, target.User, err)
+				return
+			}
+			if err := rs.Sync(); err != nil {
+				errs[i] = fmt.Errorf("%s/%s: %s", target.Org, target.User, err)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -1,21 +1,52 @@
-// reposync syncs repos for a GitHub user into a folder on your computer.
+// reposync syncs repos for a user or org on GitHub, GitLab, Gitea, or
+// Bitbucket into a folder on your computer. Run with the same flags plus a
+// trailing "status" argument (e.g.
+// `reposync -user=foo -dir=bar -archivedir=baz -token=... status`) to
+// print what a sync would do against the state file without touching git.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"runtime"
 	"strings"
 	"sync"
-
-	"github.com/google/go-github/github"
-	"golang.org/x/oauth2"
+	"time"
 )
 
+// regexpListFlag is a repeatable flag.Value that collects each -flag
+// occurrence's pattern, for flags like -include/-exclude that can be passed
+// more than once.
+type regexpListFlag []*regexp.Regexp
+
+func (r *regexpListFlag) String() string {
+	if r == nil {
+		return ""
+	}
+	patterns := make([]string, len(*r))
+	for i, re := range *r {
+		patterns[i] = re.String()
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (r *regexpListFlag) Set(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
 var Version string
 
 func main() {
@@ -29,11 +60,54 @@ func main() {
 	archivedir := flag.String("archivedir", "", "Directory to move folders in dir that are not associated with a repo")
 	token := flag.String("token", "", "GitHub token to use for auth")
 	dryrun := flag.Bool("dryrun", false, "Set to true to print actions instead of performing them")
+	update := flag.Bool("update", false, "Set to true to fetch (and pull, unless -bare) repos that are already cloned")
+	bare := flag.Bool("bare", false, "Clone repos as bare mirrors and skip pull during -update")
+	prune := flag.Bool("prune", false, "Pass --prune to git fetch during -update")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "Max concurrent git operations. Defaults to the number of CPUs; pass a negative value for unbounded")
+	provider := flag.String("provider", "github", "Git host to sync from: github, gitlab, gitea, or bitbucket")
+	host := flag.String("host", "", "Base URL of a self-hosted instance of -provider. Defaults to the provider's public SaaS. For a self-hosted GitHub (Enterprise), give the host without an /api/v3/ suffix, e.g. https://ghe.example.com")
+	config := flag.String("config", "", "Path to a YAML config describing one or more sync targets to run in a single invocation. Overrides the other flags")
+	// include/exclude/topic/language/max-size-kb/skip-archived all narrow
+	// which repos reposync considers "current" (see matchesFilters). A repo
+	// filtered out this way looks identical to one deleted upstream, so
+	// tightening any of these against an existing workdir will archive the
+	// repos that no longer match - run with -dryrun first to see the diff.
+	var include, exclude regexpListFlag
+	flag.Var(&include, "include", "Regex a repo name must match to be synced. Repeatable; a repo matching any -include passes this filter. Narrowing this against an existing -dir archives repos that stop matching")
+	flag.Var(&exclude, "exclude", "Regex a repo name must not match to be synced. Repeatable. Widening this against an existing -dir archives repos that start matching")
+	topic := flag.String("topic", "", "Only sync repos tagged with this topic. Changing it against an existing -dir archives repos that stop matching")
+	language := flag.String("language", "", "Only sync repos whose primary language matches this. Changing it against an existing -dir archives repos that stop matching")
+	maxSizeKB := flag.Int("max-size-kb", 0, "Skip repos larger than this size in KB. 0 means unlimited. Lowering it against an existing -dir archives repos that now exceed it")
+	skipArchived := flag.Bool("skip-archived", false, "Skip archived repos instead of cloning/updating them. Setting this against an existing -dir archives repos that are archived upstream")
+	retries := flag.Int("retries", 0, "Number of times to retry a failed clone/archive/update before giving up")
+	retryBase := flag.Duration("retry-base", 500*time.Millisecond, "Base delay for exponential backoff between retries")
 	flag.Parse()
 	if *versionflag {
 		fmt.Println(Version)
 		os.Exit(0)
 	}
+	if *config != "" {
+		cfg, err := LoadConfig(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if flag.Arg(0) == "status" {
+			for _, target := range cfg.Targets {
+				rs, err := target.toRepoSync(nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err := rs.Status(); err != nil {
+					log.Fatal(err)
+				}
+			}
+			return
+		}
+		if err := RunConfig(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *user == "" && *org == "" {
 		log.Fatal("must provide user or org")
 	}
@@ -56,6 +130,26 @@ func main() {
 		archivedir:    *archivedir,
 		token:         *token,
 		dryrun:        *dryrun,
+		update:        *update,
+		bare:          *bare,
+		prune:         *prune,
+		jobs:          *jobs,
+		provider:      *provider,
+		host:          *host,
+		include:       include,
+		exclude:       exclude,
+		topic:         *topic,
+		language:      *language,
+		maxSizeKB:     *maxSizeKB,
+		skipArchived:  *skipArchived,
+		retries:       *retries,
+		retryBase:     *retryBase,
+	}
+	if flag.Arg(0) == "status" {
+		if err := rs.Status(); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 	if err := rs.Sync(); err != nil {
 		log.Fatal(err)
@@ -84,6 +178,18 @@ func Difference(a, b []string) []string {
 	return diff
 }
 
+// Intersection computes the set intersection of A and B for string sets.
+func Intersection(a, b []string) []string {
+	inter := []string{}
+	for _, str := range a {
+		if !Contains(b, str) {
+			continue
+		}
+		inter = append(inter, str)
+	}
+	return inter
+}
+
 // Task runs a function and logs its progress.
 type Task struct {
 	task        func() error
@@ -94,13 +200,32 @@ func NewTask(task func() error, description string) *Task {
 	return &Task{task: task, description: description}
 }
 
-func (tws *Task) Run() {
+func (tws *Task) Run() error {
 	log.Printf("begin %s", tws.description)
 	if err := tws.task(); err != nil {
 		log.Printf("error %s: %s", tws.description, err)
-	} else {
-		log.Printf("finished %s", tws.description)
+		return err
 	}
+	log.Printf("finished %s", tws.description)
+	return nil
+}
+
+// retry runs fn, retrying up to retries more times with exponential backoff
+// and jitter between attempts if it returns an error. A retries of 0 runs fn
+// exactly once.
+func retry(fn func() error, retries int, base time.Duration) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == retries {
+			break
+		}
+		backoff := base * time.Duration(int64(1)<<uint(attempt))
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff)+1)))
+	}
+	return err
 }
 
 type RepoSync struct {
@@ -113,66 +238,116 @@ type RepoSync struct {
 	archivedir    string
 	token         string
 	dryrun        bool
+	update        bool
+	bare          bool
+	prune         bool
+	jobs          int
+	provider      string
+	host          string
+	include       []*regexp.Regexp
+	exclude       []*regexp.Regexp
+	topic         string
+	language      string
+	maxSizeKB     int
+	skipArchived  bool
+	retries       int
+	retryBase     time.Duration
+	// pool, if set, bounds concurrent git operations across this RepoSync and
+	// any others sharing it (see RunConfig). When nil, Sync makes its own pool
+	// sized by jobs for the duration of each fan-out below.
+	pool chan struct{}
+}
+
+// workerPool returns the worker pool to bound a fan-out of n tasks, falling
+// back to a pool sized by jobs when rs isn't sharing one with other targets.
+// A negative jobs is the explicit opt-in for unbounded concurrency (sized to
+// n); a positive jobs bounds the pool to that many concurrent operations, and
+// 0 is treated as 1.
+func (rs RepoSync) workerPool(n int) chan struct{} {
+	if rs.pool != nil {
+		return rs.pool
+	}
+	size := rs.jobs
+	if size < 0 {
+		size = n
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return make(chan struct{}, size)
+}
+
+// matchesFilters reports whether repo passes rs's -include/-exclude/-topic/
+// -language/-max-size-kb/-skip-archived filters. All of these are evaluated
+// against fields the list APIs already return, so filtering never costs an
+// extra request. A field a provider's lister doesn't fill in is empty: the
+// GitLab lister sets no Language or SizeKB, and the Gitea and Bitbucket
+// listers set no Topics, so -language/-topic exclude every repo from those
+// providers and -max-size-kb excludes no GitLab repo.
+func (rs RepoSync) matchesFilters(repo RemoteRepo) bool {
+	if rs.skipArchived && repo.Archived {
+		return false
+	}
+	if len(rs.include) > 0 {
+		var matched bool
+		for _, re := range rs.include {
+			if re.MatchString(repo.Name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, re := range rs.exclude {
+		if re.MatchString(repo.Name) {
+			return false
+		}
+	}
+	if rs.topic != "" && !Contains(repo.Topics, rs.topic) {
+		return false
+	}
+	if rs.language != "" && !strings.EqualFold(repo.Language, rs.language) {
+		return false
+	}
+	if rs.maxSizeKB > 0 && repo.SizeKB > rs.maxSizeKB {
+		return false
+	}
+	return true
 }
 
 func (rs RepoSync) Sync() error {
 
-	// get list of repos for org
+	// get list of repos for org/user from whichever provider is configured,
+	// keyed by name so the clone step below can look up each repo's URLs
 	var allRepos []string
-	NewTask(func() error {
-		ts := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: rs.token},
-		)
-		tc := oauth2.NewClient(oauth2.NoContext, ts)
-		client := github.NewClient(tc)
-		if rs.org != "" {
-			opt := &github.RepositoryListByOrgOptions{
-				Type:        rs.orgRepoType,
-				ListOptions: github.ListOptions{PerPage: 100},
-			}
-			for {
-				repos, resp, err := client.Repositories.ListByOrg(rs.org, opt)
-				if err != nil {
-					return err
-				}
-				for _, repo := range repos {
-					if repo.Name == nil {
-						continue
-					}
-					allRepos = append(allRepos, *repo.Name)
-				}
-				if resp.NextPage == 0 {
-					break
-				}
-				opt.ListOptions.Page = resp.NextPage
-			}
-		} else if rs.user != "" {
-			opt := &github.RepositoryListOptions{
-				Type:        rs.userRepoType,
-				ListOptions: github.ListOptions{PerPage: 1000},
+	remoteRepos := map[string]RemoteRepo{}
+	if err := NewTask(func() error {
+		lister, err := NewRepoLister(rs.provider, rs.host, rs)
+		if err != nil {
+			return err
+		}
+		repos, err := lister.ListRepos()
+		if err != nil {
+			return err
+		}
+		for _, repo := range repos {
+			if rs.user != "" && rs.org == "" && !rs.userRepoForks && repo.Fork {
+				continue
 			}
-			for {
-				repos, resp, err := client.Repositories.List(rs.user, opt)
-				if err != nil {
-					return err
-				}
-				for _, repo := range repos {
-					if repo.Name == nil {
-						continue
-					}
-					if rs.userRepoForks == false && repo.Fork != nil && *repo.Fork {
-						continue
-					}
-					allRepos = append(allRepos, *repo.Name)
-				}
-				if resp.NextPage == 0 {
-					break
-				}
-				opt.ListOptions.Page = resp.NextPage
+			if !rs.matchesFilters(repo) {
+				continue
 			}
+			remoteRepos[repo.Name] = repo
+			allRepos = append(allRepos, repo.Name)
 		}
 		return nil
-	}, fmt.Sprintf("loading repos for %s %s", rs.org, rs.user)).Run()
+	}, fmt.Sprintf("loading repos for %s %s", rs.org, rs.user)).Run(); err != nil {
+		// a failed listing must not fall through to the archive/clone diff
+		// below, or every locally-cloned repo looks like it's gone upstream
+		return err
+	}
 
 	// get list of current repositories checked out, ignoring non-directories and hidden directories
 	var currentRepos []string
@@ -190,52 +365,175 @@ func (rs RepoSync) Sync() error {
 	reposToArchive := Difference(currentRepos, allRepos)
 	reposToClone := Difference(allRepos, currentRepos)
 
-	if len(reposToArchive)+len(reposToClone) == 0 {
+	if len(reposToArchive)+len(reposToClone) == 0 && !rs.update {
 		log.Print("nothing to do!")
 		return nil
 	}
 
+	state, err := LoadState(rs.workdir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var errsMu sync.Mutex
+	addErr := func(err error) {
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		errs = append(errs, err)
+	}
+	var stateMu sync.Mutex
+	recordState := func(r string, s RepoState) {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		state.Repos[r] = s
+	}
+
 	var archivers sync.WaitGroup
 	if err := os.MkdirAll(rs.archivedir, 0755); err != nil {
 		return err
 	}
+	archivePool := rs.workerPool(len(reposToArchive))
 	for _, repo := range reposToArchive {
 		archivers.Add(1)
+		archivePool <- struct{}{}
 		go func(r string) {
 			defer archivers.Done()
-			NewTask(func() error {
+			defer func() { <-archivePool }()
+			err := NewTask(func() error {
 				if rs.dryrun {
 					return nil
 				}
-				return os.Rename(path.Join(rs.workdir, r), path.Join(rs.archivedir, r))
+				return retry(func() error {
+					return os.Rename(path.Join(rs.workdir, r), path.Join(rs.archivedir, r))
+				}, rs.retries, rs.retryBase)
 			}, fmt.Sprintf("archiving %s", r)).Run()
+			if err != nil {
+				addErr(fmt.Errorf("archiving %s: %w", r, err))
+				return
+			}
+			if !rs.dryrun {
+				recordState(r, RepoState{Archived: true})
+			}
 		}(repo)
 	}
 
 	var cloners sync.WaitGroup
+	clonePool := rs.workerPool(len(reposToClone))
 	for _, repo := range reposToClone {
 		cloners.Add(1)
+		clonePool <- struct{}{}
 		go func(r string) {
 			defer cloners.Done()
-			NewTask(func() error {
+			defer func() { <-clonePool }()
+			err := NewTask(func() error {
 				if rs.dryrun {
 					return nil
 				}
-				if rs.org != "" {
-					if output, err := exec.Command("git", "clone", fmt.Sprintf("git@github.com:%s/%s", rs.org, r), path.Join(rs.workdir, r)).CombinedOutput(); err != nil {
+				return retry(func() error {
+					remote := remoteRepos[r]
+					cloneURL := remote.SSHURL
+					if cloneURL == "" {
+						cloneURL = remote.CloneURL
+					}
+					args := []string{"clone"}
+					if rs.bare {
+						args = append(args, "--mirror")
+					}
+					args = append(args, cloneURL, path.Join(rs.workdir, r))
+					if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
 						return fmt.Errorf("%s from %s", err, output)
 					}
 					return nil
-				}
-				if output, err := exec.Command("git", "clone", fmt.Sprintf("git@github.com:%s/%s", rs.user, r), path.Join(rs.workdir, r)).CombinedOutput(); err != nil {
-					return fmt.Errorf("%s from %s", err, output)
-				}
-				return nil
+				}, rs.retries, rs.retryBase)
 			}, fmt.Sprintf("cloning %s", r)).Run()
+			if err != nil {
+				addErr(fmt.Errorf("cloning %s: %w", r, err))
+				return
+			}
+			if !rs.dryrun {
+				remote := remoteRepos[r]
+				sha, _ := headSHA(path.Join(rs.workdir, r))
+				recordState(r, RepoState{
+					PushedAt:      remote.PushedAt,
+					UpdatedAt:     remote.UpdatedAt,
+					DefaultBranch: remote.DefaultBranch,
+					HeadSHA:       sha,
+				})
+			}
 		}(repo)
 	}
 
 	archivers.Wait()
 	cloners.Wait()
-	return nil
+
+	if rs.update {
+		reposToUpdate := Intersection(currentRepos, allRepos)
+		updatePool := rs.workerPool(len(reposToUpdate))
+		// Snapshot state.Repos before spawning goroutines: recordState writes
+		// into state.Repos from these same goroutines, and Go maps aren't safe
+		// for concurrent read+write even across distinct keys.
+		priorState := make(map[string]RepoState, len(state.Repos))
+		for name, s := range state.Repos {
+			priorState[name] = s
+		}
+		var updaters sync.WaitGroup
+		for _, repo := range reposToUpdate {
+			updaters.Add(1)
+			updatePool <- struct{}{}
+			go func(r string) {
+				defer updaters.Done()
+				defer func() { <-updatePool }()
+				remote := remoteRepos[r]
+				if prior, ok := priorState[r]; ok && !remote.PushedAt.IsZero() && !remote.PushedAt.After(prior.PushedAt) {
+					log.Printf("skipping update for %s: no upstream changes since last sync", r)
+					return
+				}
+				err := NewTask(func() error {
+					if rs.dryrun {
+						return nil
+					}
+					return retry(func() error {
+						repopath := path.Join(rs.workdir, r)
+						fetchArgs := []string{"-C", repopath, "fetch", "--all", "--tags"}
+						if rs.prune {
+							fetchArgs = append(fetchArgs, "--prune")
+						}
+						if output, err := exec.Command("git", fetchArgs...).CombinedOutput(); err != nil {
+							return fmt.Errorf("%s from %s", err, output)
+						}
+						if rs.bare {
+							return nil
+						}
+						if output, err := exec.Command("git", "-C", repopath, "pull", "--ff-only").CombinedOutput(); err != nil {
+							return fmt.Errorf("%s from %s", err, output)
+						}
+						return nil
+					}, rs.retries, rs.retryBase)
+				}, fmt.Sprintf("updating %s", r)).Run()
+				if err != nil {
+					addErr(fmt.Errorf("updating %s: %w", r, err))
+					return
+				}
+				if !rs.dryrun {
+					sha, _ := headSHA(path.Join(rs.workdir, r))
+					recordState(r, RepoState{
+						PushedAt:      remote.PushedAt,
+						UpdatedAt:     remote.UpdatedAt,
+						DefaultBranch: remote.DefaultBranch,
+						HeadSHA:       sha,
+					})
+				}
+			}(repo)
+		}
+		updaters.Wait()
+	}
+
+	if !rs.dryrun {
+		if err := state.Save(rs.workdir); err != nil {
+			addErr(fmt.Errorf("saving state: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// RemoteRepo is a repository as reported by a Git hosting provider,
+// normalized across the provider-specific APIs so the sync loop can stay
+// provider-agnostic.
+type RemoteRepo struct {
+	Name     string
+	CloneURL string
+	SSHURL   string
+	Fork     bool
+	Archived bool
+	Private  bool
+	Language string
+	Topics   []string
+	SizeKB   int
+
+	// DefaultBranch, UpdatedAt, and PushedAt feed the state file (state.go);
+	// Sync compares PushedAt against it to decide whether a repo needs
+	// fetching again.
+	DefaultBranch string
+	UpdatedAt     time.Time
+	PushedAt      time.Time
+}
+
+// RepoLister lists the repositories belonging to a user or organization on a
+// Git hosting provider.
+type RepoLister interface {
+	ListRepos() ([]RemoteRepo, error)
+}
+
+// NewRepoLister builds the RepoLister for the given provider name. host, if
+// non-empty, points the provider at a self-hosted instance instead of the
+// public SaaS API.
+func NewRepoLister(provider, host string, rs RepoSync) (RepoLister, error) {
+	switch provider {
+	case "", "github":
+		return &GitHubLister{rs: rs, host: host}, nil
+	case "gitlab":
+		return &GitLabLister{rs: rs, host: host}, nil
+	case "gitea":
+		return &GiteaLister{rs: rs, host: host}, nil
+	case "bitbucket":
+		return &BitbucketLister{rs: rs, host: host}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", provider)
+}
+
+// GitHubLister lists repos from github.com or a GitHub Enterprise instance.
+type GitHubLister struct {
+	rs   RepoSync
+	host string
+}
+
+// client builds the GitHub API client. For a self-hosted instance, l.host is
+// the GitHub Enterprise hostname (e.g. "https://ghe.example.com") -
+// NewEnterpriseClient appends the "/api/v3/" and "/api/uploads/" paths
+// itself, so -host should NOT include them.
+func (l *GitHubLister) client() (*github.Client, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: l.rs.token},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	if l.host == "" {
+		return github.NewClient(tc), nil
+	}
+	return github.NewEnterpriseClient(l.host, l.host, tc)
+}
+
+func (l *GitHubLister) ListRepos() ([]RemoteRepo, error) {
+	client, err := l.client()
+	if err != nil {
+		return nil, err
+	}
+	var repos []RemoteRepo
+	if l.rs.org != "" {
+		opt := &github.RepositoryListByOrgOptions{
+			Type:        l.rs.orgRepoType,
+			ListOptions: github.ListOptions{PerPage: 100},
+		}
+		for {
+			page, resp, err := client.Repositories.ListByOrg(l.rs.org, opt)
+			if err != nil {
+				return nil, err
+			}
+			repos = append(repos, githubReposToRemoteRepos(page)...)
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.ListOptions.Page = resp.NextPage
+		}
+		return repos, nil
+	}
+	opt := &github.RepositoryListOptions{
+		Type:        l.rs.userRepoType,
+		ListOptions: github.ListOptions{PerPage: 1000},
+	}
+	for {
+		page, resp, err := client.Repositories.List(l.rs.user, opt)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, githubReposToRemoteRepos(page)...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return repos, nil
+}
+
+func githubReposToRemoteRepos(repos []*github.Repository) []RemoteRepo {
+	var out []RemoteRepo
+	for _, repo := range repos {
+		if repo.Name == nil {
+			continue
+		}
+		r := RemoteRepo{Name: *repo.Name}
+		if repo.CloneURL != nil {
+			r.CloneURL = *repo.CloneURL
+		}
+		if repo.SSHURL != nil {
+			r.SSHURL = *repo.SSHURL
+		}
+		if repo.Fork != nil {
+			r.Fork = *repo.Fork
+		}
+		if repo.Archived != nil {
+			r.Archived = *repo.Archived
+		}
+		if repo.Private != nil {
+			r.Private = *repo.Private
+		}
+		if repo.Language != nil {
+			r.Language = *repo.Language
+		}
+		if repo.Size != nil {
+			r.SizeKB = *repo.Size
+		}
+		if repo.DefaultBranch != nil {
+			r.DefaultBranch = *repo.DefaultBranch
+		}
+		if repo.UpdatedAt != nil {
+			r.UpdatedAt = repo.UpdatedAt.Time
+		}
+		if repo.PushedAt != nil {
+			r.PushedAt = repo.PushedAt.Time
+		}
+		r.Topics = repo.Topics
+		out = append(out, r)
+	}
+	return out
+}
+
+// httpGetJSON performs an authenticated GET and decodes the JSON response
+// body into v. It's shared by the self-hosted-oriented providers below,
+// which don't warrant pulling in a full API client library.
+func httpGetJSON(url, token, authHeader string, v interface{}) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("%s %s", authHeader, token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp, fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GitLabLister lists repos ("projects") from gitlab.com or a self-hosted
+// GitLab instance.
+type GitLabLister struct {
+	rs   RepoSync
+	host string
+}
+
+type gitlabProject struct {
+	Path              string    `json:"path"`
+	HTTPURLToRepo     string    `json:"http_url_to_repo"`
+	SSHURLToRepo      string    `json:"ssh_url_to_repo"`
+	Archived          bool      `json:"archived"`
+	Visibility        string    `json:"visibility"`
+	Topics            []string  `json:"topics"`
+	DefaultBranch     string    `json:"default_branch"`
+	LastActivityAt    time.Time `json:"last_activity_at"`
+	ForkedFromProject *struct {
+		ID int `json:"id"`
+	} `json:"forked_from_project"`
+}
+
+func (l *GitLabLister) baseURL() string {
+	if l.host != "" {
+		return l.host
+	}
+	return "https://gitlab.com"
+}
+
+func (l *GitLabLister) ListRepos() ([]RemoteRepo, error) {
+	owner := l.rs.org
+	ownerSegment := "groups"
+	if owner == "" {
+		owner = l.rs.user
+		ownerSegment = "users"
+	}
+	var repos []RemoteRepo
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v4/%s/%s/projects?per_page=100&page=%d", l.baseURL(), ownerSegment, owner, page)
+		var projects []gitlabProject
+		if _, err := httpGetJSON(url, l.rs.token, "Bearer", &projects); err != nil {
+			return nil, err
+		}
+		if len(projects) == 0 {
+			break
+		}
+		for _, p := range projects {
+			repos = append(repos, RemoteRepo{
+				Name:          p.Path,
+				CloneURL:      p.HTTPURLToRepo,
+				SSHURL:        p.SSHURLToRepo,
+				Fork:          p.ForkedFromProject != nil,
+				Archived:      p.Archived,
+				Private:       p.Visibility == "private",
+				Topics:        p.Topics,
+				DefaultBranch: p.DefaultBranch,
+				// GitLab doesn't distinguish pushed-at from last-activity-at.
+				UpdatedAt: p.LastActivityAt,
+				PushedAt:  p.LastActivityAt,
+			})
+		}
+	}
+	return repos, nil
+}
+
+// GiteaLister lists repos from a Gitea instance (gitea.com or self-hosted).
+type GiteaLister struct {
+	rs   RepoSync
+	host string
+}
+
+type giteaRepo struct {
+	Name          string    `json:"name"`
+	CloneURL      string    `json:"clone_url"`
+	SSHURL        string    `json:"ssh_url"`
+	Fork          bool      `json:"fork"`
+	Archived      bool      `json:"archived"`
+	Private       bool      `json:"private"`
+	Language      string    `json:"language"`
+	Size          int       `json:"size"`
+	DefaultBranch string    `json:"default_branch"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (l *GiteaLister) baseURL() string {
+	if l.host != "" {
+		return l.host
+	}
+	return "https://gitea.com"
+}
+
+func (l *GiteaLister) ListRepos() ([]RemoteRepo, error) {
+	owner := l.rs.org
+	ownerSegment := "orgs"
+	if owner == "" {
+		owner = l.rs.user
+		ownerSegment = "users"
+	}
+	var repos []RemoteRepo
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v1/%s/%s/repos?limit=50&page=%d", l.baseURL(), ownerSegment, owner, page)
+		var repoPage []giteaRepo
+		if _, err := httpGetJSON(url, l.rs.token, "token", &repoPage); err != nil {
+			return nil, err
+		}
+		if len(repoPage) == 0 {
+			break
+		}
+		for _, r := range repoPage {
+			repos = append(repos, RemoteRepo{
+				Name:          r.Name,
+				CloneURL:      r.CloneURL,
+				SSHURL:        r.SSHURL,
+				Fork:          r.Fork,
+				Archived:      r.Archived,
+				Private:       r.Private,
+				Language:      r.Language,
+				SizeKB:        r.Size,
+				DefaultBranch: r.DefaultBranch,
+				UpdatedAt:     r.UpdatedAt,
+				// Gitea's API doesn't expose pushed-at separately from updated-at.
+				PushedAt: r.UpdatedAt,
+			})
+		}
+	}
+	return repos, nil
+}
+
+// BitbucketLister lists repos through the Bitbucket Cloud 2.0 API. host
+// replaces its base URL (https://api.bitbucket.org/2.0), so it has to point at
+// a server that speaks that same API; the different REST API of Bitbucket
+// Server/Data Center is not supported.
+type BitbucketLister struct {
+	rs   RepoSync
+	host string
+}
+
+type bitbucketRepo struct {
+	Name       string                 `json:"name"`
+	Parent     map[string]interface{} `json:"parent"`
+	Private    bool                   `json:"is_private"`
+	Language   string                 `json:"language"`
+	Size       int                    `json:"size"`
+	UpdatedOn  time.Time              `json:"updated_on"`
+	MainBranch struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+	Links struct {
+		Clone []struct {
+			Name string `json:"name"`
+			Href string `json:"href"`
+		} `json:"clone"`
+	} `json:"links"`
+}
+
+type bitbucketResponse struct {
+	Values []bitbucketRepo `json:"values"`
+	Next   string          `json:"next"`
+}
+
+func (l *BitbucketLister) baseURL() string {
+	if l.host != "" {
+		return l.host
+	}
+	return "https://api.bitbucket.org/2.0"
+}
+
+func (l *BitbucketLister) ListRepos() ([]RemoteRepo, error) {
+	owner := l.rs.org
+	if owner == "" {
+		owner = l.rs.user
+	}
+	var repos []RemoteRepo
+	url := fmt.Sprintf("%s/repositories/%s?pagelen=100", l.baseURL(), owner)
+	for url != "" {
+		var resp bitbucketResponse
+		if _, err := httpGetJSON(url, l.rs.token, "Bearer", &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Values {
+			remote := RemoteRepo{
+				Name:          r.Name,
+				Private:       r.Private,
+				Fork:          r.Parent != nil,
+				Language:      r.Language,
+				SizeKB:        r.Size / 1024,
+				DefaultBranch: r.MainBranch.Name,
+				UpdatedAt:     r.UpdatedOn,
+				PushedAt:      r.UpdatedOn,
+			}
+			for _, clone := range r.Links.Clone {
+				switch clone.Name {
+				case "https":
+					remote.CloneURL = clone.Href
+				case "ssh":
+					remote.SSHURL = clone.Href
+				}
+			}
+			repos = append(repos, remote)
+		}
+		url = resp.Next
+	}
+	return repos, nil
+}
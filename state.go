@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// stateFileName is the snapshot reposync keeps in each workdir so later runs
+// can skip fetching repos that haven't changed upstream and can answer
+// "what changed since last time" via `reposync status`.
+const stateFileName = ".reposync-state.json"
+
+// RepoState is what's recorded for a single repo between runs.
+type RepoState struct {
+	PushedAt      time.Time `json:"pushed_at,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at,omitempty"`
+	DefaultBranch string    `json:"default_branch,omitempty"`
+	HeadSHA       string    `json:"head_sha,omitempty"`
+	Archived      bool      `json:"archived"`
+}
+
+// State is the on-disk snapshot of every repo reposync knows about for a
+// given workdir, keyed by repo name.
+type State struct {
+	Repos map[string]RepoState `json:"repos"`
+}
+
+func statePath(workdir string) string {
+	return path.Join(workdir, stateFileName)
+}
+
+// LoadState reads the state file for workdir, returning an empty State if
+// none has been written yet.
+func LoadState(workdir string) (*State, error) {
+	data, err := ioutil.ReadFile(statePath(workdir))
+	if os.IsNotExist(err) {
+		return &State{Repos: map[string]RepoState{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Repos == nil {
+		state.Repos = map[string]RepoState{}
+	}
+	return &state, nil
+}
+
+// Save writes state to the state file for workdir.
+func (state *State) Save(workdir string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(workdir), data, 0644)
+}
+
+// headSHA returns the current HEAD commit of the git repo at repopath. It
+// only reads local state - no fetch or other network operation.
+func headSHA(repopath string) (string, error) {
+	output, err := exec.Command("git", "-C", repopath, "rev-parse", "HEAD").CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
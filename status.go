@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// Status prints what a Sync would do against the current state file and
+// local/remote reality, without performing any clone, fetch, or archive.
+func (rs RepoSync) Status() error {
+	lister, err := NewRepoLister(rs.provider, rs.host, rs)
+	if err != nil {
+		return err
+	}
+	repos, err := lister.ListRepos()
+	if err != nil {
+		return err
+	}
+	remoteRepos := map[string]RemoteRepo{}
+	var allRepos []string
+	for _, repo := range repos {
+		if rs.user != "" && rs.org == "" && !rs.userRepoForks && repo.Fork {
+			continue
+		}
+		if !rs.matchesFilters(repo) {
+			continue
+		}
+		remoteRepos[repo.Name] = repo
+		allRepos = append(allRepos, repo.Name)
+	}
+
+	var currentRepos []string
+	files, err := ioutil.ReadDir(rs.workdir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() || strings.Index(f.Name(), ".") == 0 {
+			continue
+		}
+		currentRepos = append(currentRepos, f.Name())
+	}
+
+	state, err := LoadState(rs.workdir)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range Difference(allRepos, currentRepos) {
+		fmt.Printf("+ %s would be cloned\n", r)
+	}
+	for _, r := range Difference(currentRepos, allRepos) {
+		fmt.Printf("- %s would be archived\n", r)
+	}
+	for _, r := range Intersection(currentRepos, allRepos) {
+		remote := remoteRepos[r]
+		prior, known := state.Repos[r]
+		if !known {
+			fmt.Printf("? %s has no recorded state yet\n", r)
+			continue
+		}
+		if !remote.PushedAt.IsZero() && remote.PushedAt.After(prior.PushedAt) {
+			fmt.Printf("~ %s has upstream changes since last sync (pushed %s)\n", r, remote.PushedAt.Format(time.RFC3339))
+		}
+		if sha, err := headSHA(path.Join(rs.workdir, r)); err == nil && prior.HeadSHA != "" && sha != prior.HeadSHA {
+			fmt.Printf("! %s has local drift: HEAD is %s, state recorded %s\n", r, sha, prior.HeadSHA)
+		}
+	}
+
+	archived, err := ioutil.ReadDir(rs.archivedir)
+	if err == nil {
+		for _, f := range archived {
+			if f.IsDir() && Contains(allRepos, f.Name()) {
+				fmt.Printf("! %s was archived but has reappeared upstream\n", f.Name())
+			}
+		}
+	}
+
+	return nil
+}